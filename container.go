@@ -1,8 +1,11 @@
 // Package `di` implements basic dependency injection (DI) container.
 package di
 
+import "context"
+import "errors"
 import "fmt"
 import "reflect"
+import "strings"
 import "sync"
 
 // `Lifetime` represents lifetime of instance resolved by container.
@@ -32,6 +35,89 @@ type Constructor func(c Container) (interface{}, error)
 // `Destructor` is cleanup function for created instance.
 type Destructor func(i interface{}) error
 
+// `AsyncDestructor` is a context-aware cleanup function for created
+// instance, used by `RegisterFactoryContext`/`UseFactoryContext`.
+//
+// Unlike `Destructor`, it receives the `context.Context` passed to
+// `CloseContext`, so a long-running cleanup can honor `ctx.Done()`.
+type AsyncDestructor func(ctx context.Context, i interface{}) error
+
+// `ResolveContext` describes the resolution currently in progress. It is
+// passed to the predicate supplied to `BindingBuilder.When`, so that a
+// binding can be chosen based on who is asking for it.
+type ResolveContext struct {
+	// `Ctx` is the `context.Context` passed to the innermost
+	// `Container.ResolveContext` call this resolution descends from, or
+	// nil if it was started by `Resolve`/`Inject` instead. It is also nil
+	// while the dependencies of a `Scoped`/`Singleton` instance are
+	// resolved, since that construction is shared by every caller.
+	Ctx context.Context
+
+	// `Tag` is the tag being resolved.
+	Tag string
+
+	// `ParentType` is the type of the struct whose field is being
+	// injected, or nil if `Tag` is not being resolved for field
+	// injection (e.g. a top-level `Resolve` call).
+	ParentType reflect.Type
+
+	// `FieldName` is the name of the struct field being injected, or
+	// empty if `ParentType` is nil.
+	FieldName string
+
+	// `Chain` is the chain of tags currently being resolved, from
+	// outermost to innermost, not including `Tag` itself.
+	Chain []string
+
+	// `collector` gathers the destructor entries created while
+	// resolving `Tag`'s dependencies, so that the entry (if any)
+	// created for `Tag` itself can depend on them. See `createInstance`.
+	collector *childCollector
+}
+
+// `child` returns the `ResolveContext` for resolving `tag` as a
+// dependency of the instance currently being constructed under `this`
+// context.
+func (this ResolveContext) child(tag string, parentType reflect.Type, fieldName string) ResolveContext {
+	chain := this.Chain
+	if this.Tag != "" {
+		chain = append(append([]string{}, chain...), this.Tag)
+	}
+
+	return ResolveContext{
+		Ctx:        this.Ctx,
+		Tag:        tag,
+		ParentType: parentType,
+		FieldName:  fieldName,
+		Chain:      chain,
+		collector:  this.collector,
+	}
+}
+
+// `BindingBuilder` fluently configures a single binding registered by
+// `Container.Bind`.
+type BindingBuilder interface {
+	// `To` sets the binding's implementation, same as `RegisterType`.
+	To(impl interface{}) BindingBuilder
+
+	// `ToFactory` sets the binding's constructor and destructor, same
+	// as `RegisterFactory`.
+	ToFactory(ctor Constructor, dtor Destructor) BindingBuilder
+
+	// `In` sets the binding's lifetime. Defaults to `Transient`.
+	In(lifetime Lifetime) BindingBuilder
+
+	// `As` sets the tag the binding is registered under. Defaults to
+	// the type name of the value passed to `Bind`.
+	As(tag string) BindingBuilder
+
+	// `When` restricts the binding to resolutions for which `predicate`
+	// returns true. If multiple bindings match a tag, `Resolve` picks
+	// the last registered one whose predicate returns true, falling
+	// back to the last registered binding without a predicate.
+	When(predicate func(ResolveContext) bool) BindingBuilder
+}
+
 // `Container` is type registry and dependency resolver.
 //
 // You can use `RegisterType`, `RegisterValue` or `RegisterFactory` to
@@ -68,6 +154,36 @@ type Container interface {
 	// TODO: inspect type name from constructor return value
 	RegisterFactory(v interface{}, ctor Constructor, dtor Destructor, lifetime Lifetime)
 
+	// `RegisterFactoryContext` registers factory method for type name of
+	// `v`, same as `RegisterFactory`, but with a context-aware
+	// `AsyncDestructor` instead of a `Destructor`.
+	RegisterFactoryContext(v interface{}, ctor Constructor, dtor AsyncDestructor, lifetime Lifetime)
+
+	// `RegisterImpl` registers `implPtr`'s type for `ifacePtr`'s interface
+	// type name (`reflect.TypeOf(ifacePtr).Elem().String()`), so that the
+	// implementation can be resolved by the interface it implements.
+	//
+	// `ifacePtr` is a typed nil pointer to the interface (e.g. `(*Logger)(nil)`),
+	// and `implPtr` is a zero value of the concrete implementation, same as
+	// `RegisterType`. `RegisterImpl` panics if the implementation does not
+	// implement the interface.
+	RegisterImpl(ifacePtr interface{}, implPtr interface{}, lifetime Lifetime)
+
+	// `RegisterConstructor` registers `fn` for the type name of its return
+	// value.
+	//
+	// `fn` must be a `func(Dep1, Dep2, ...) (T, error)` or
+	// `func(Dep1, Dep2, ...) T`. Each parameter is resolved from the
+	// container by its type name (`reflect.Type.String()`) and passed to
+	// `fn`; the returned `T` is registered as the created instance. If `fn`
+	// returns an error, it is propagated as the factory's error.
+	RegisterConstructor(fn interface{}, lifetime Lifetime)
+
+	// `Bind` starts a fluent binding for the type name of `v`, same as
+	// `RegisterType`. Use the returned `BindingBuilder` to customize the
+	// implementation, lifetime, tag or `When` predicate.
+	Bind(v interface{}) BindingBuilder
+
 	// `Use` sets an alias for other tag or type name.
 	Use(tag string, tagOrTypeName string)
 
@@ -86,6 +202,22 @@ type Container interface {
 	// See `RegisterFactory`.
 	UseFactory(tag string, ctor Constructor, dtor Destructor, lifetime Lifetime)
 
+	// `UseFactoryContext` registers factory method for specified tag.
+	//
+	// See `RegisterFactoryContext`.
+	UseFactoryContext(tag string, ctor Constructor, dtor AsyncDestructor, lifetime Lifetime)
+
+	// `UseImpl` registers implementation for specified tag, additionally
+	// verifying that it implements the interface pointed to by `ifacePtr`.
+	//
+	// See `RegisterImpl`.
+	UseImpl(tag string, ifacePtr interface{}, implPtr interface{}, lifetime Lifetime)
+
+	// `UseConstructor` registers constructor function for specified tag.
+	//
+	// See `RegisterConstructor`.
+	UseConstructor(tag string, fn interface{}, lifetime Lifetime)
+
 	// `Resolve` returns instance for specified tag.
 	//
 	// If multiple type is registered for tag,
@@ -97,6 +229,18 @@ type Container interface {
 	// `ResolveAll` returns slice of instances for specified tag.
 	ResolveAll(tag string) ([]interface{}, error)
 
+	// `ResolveContext` resolves `tag`, same as `Resolve`, but honors
+	// `ctx.Done()`: `ctx` is checked before `tag` and each of its nested
+	// dependencies is resolved, and while waiting for a `Scoped`/`Singleton`
+	// instance to be constructed; once `ctx` is cancelled, resolution stops
+	// at the next such check with `ctx.Err()`. A constructor that is
+	// already running is not interrupted.
+	//
+	// It also detects circular dependencies (a tag depending, directly
+	// or indirectly, on itself) and returns an error wrapping
+	// `ErrCircularDependency` instead of recursing forever.
+	ResolveContext(ctx context.Context, tag string) (interface{}, error)
+
 	// `Inject` fills struct `v`'s fields with resolved instances
 	// if field with tagged as `di:"<tag>"`
 	Inject(v interface{}) error
@@ -104,6 +248,16 @@ type Container interface {
 	// `Close` invokes destructors for all instances resolved by
 	// the container.
 	Close() error
+
+	// `CloseContext` is the context-aware counterpart of `Close`.
+	//
+	// Destructors run in reverse-registration order, but destructors of
+	// independently-resolved instances run concurrently within the same
+	// "generation"; an instance resolved while constructing another one
+	// is always destroyed after that other one. `ctx.Done()` aborts any generation not
+	// yet started. All destructor errors (and, if aborted, `ctx.Err()`)
+	// are combined with `errors.Join`.
+	CloseContext(ctx context.Context) error
 }
 
 // `Registry` is global registry of types being resolved by containers.
@@ -111,25 +265,116 @@ var Registry Container = newContainer(nil)
 
 var ErrNoMatchingTag error = fmt.Errorf("no matching tag found")
 
+// `ErrCircularDependency` is the sentinel wrapped by the error returned
+// when `Resolve` detects that a tag is being resolved as its own
+// (possibly indirect) dependency. Use `errors.Is` to test for it; the
+// concrete error also carries the chain of tags that formed the cycle.
+var ErrCircularDependency error = fmt.Errorf("circular dependency detected")
+
+type circularDependencyError struct {
+	Chain []string
+}
+
+func (this *circularDependencyError) Error() string {
+	return fmt.Sprintf("%s: %s", ErrCircularDependency, strings.Join(this.Chain, " -> "))
+}
+
+func (this *circularDependencyError) Unwrap() error {
+	return ErrCircularDependency
+}
+
 type container struct {
 	parent      *container
 	aliases     []*alias
 	factories   []*factory
-	cache       map[*factory]interface{}
-	destructors []func() error
+	cache       sync.Map
+	destructors []*destructorEntry
 	lock        sync.RWMutex
 }
 
+// `cacheEntry` holds the single-flighted result of constructing a
+// `Scoped`/`Singleton` factory: `done` is closed exactly once, after the
+// constructor has returned, by the goroutine that the caller whose
+// `LoadOrStore` first creates the entry starts to run it; every caller,
+// that first one included, waits on `done` (or its own `Ctx`, see
+// `singleflight`) instead of racing the constructor itself. `dtorEntry` (and, if the factory has no
+// destructor, `children`) let callers that hit the cache after the
+// first one still record the same shutdown-ordering dependency.
+//
+// A failed construction is not cached: `singleflight` removes the entry
+// from `scope.cache` on error so the next `Resolve` retries instead of
+// replaying the same failure forever.
+type cacheEntry struct {
+	done      chan struct{}
+	val       interface{}
+	err       error
+	dtorEntry *destructorEntry
+	children  []*destructorEntry
+}
+
+func newCacheEntry() *cacheEntry {
+	return &cacheEntry{done: make(chan struct{})}
+}
+
+// `destructorEntry` is one resolved instance's pending cleanup. `deps`
+// lists the entries created while resolving this instance's own
+// dependencies; `CloseContext` destroys an entry only after every entry
+// whose `deps` include it has finished, and destroys the entries in its
+// own `deps` after it, so dependents are torn down before what they
+// depend on.
+type destructorEntry struct {
+	run  func(ctx context.Context) error
+	deps []*destructorEntry
+}
+
+// `childCollector` gathers the `destructorEntry`s created while
+// resolving a single instance's dependencies. It is safe for concurrent
+// use, since a constructor may resolve its dependencies from more than
+// one goroutine, each of which appends to it.
+type childCollector struct {
+	lock    sync.Mutex
+	entries []*destructorEntry
+}
+
+func (this *childCollector) add(entries ...*destructorEntry) {
+	if len(entries) == 0 {
+		return
+	}
+
+	this.lock.Lock()
+	this.entries = append(this.entries, entries...)
+	this.lock.Unlock()
+}
+
 type alias struct {
 	Tag     string
 	Aliased string
 }
 
 type factory struct {
-	Tag         string
-	Lifetime    Lifetime
-	Constructor Constructor
-	Destructor  Destructor
+	Tag             string
+	Lifetime        Lifetime
+	Constructor     Constructor
+	Destructor      Destructor
+	AsyncDestructor AsyncDestructor
+	Predicate       func(ResolveContext) bool
+}
+
+// `destroy` invokes whichever destructor is registered for this
+// factory, preferring `AsyncDestructor` and falling back to wrapping
+// `Destructor` (which ignores `ctx`).
+func (this *factory) destroy(ctx context.Context, v interface{}) error {
+	if this.AsyncDestructor != nil {
+		return this.AsyncDestructor(ctx, v)
+	}
+	if this.Destructor != nil {
+		return this.Destructor(v)
+	}
+	return nil
+}
+
+func (this *factory) hasDestructor() bool {
+	return this.Destructor != nil || this.AsyncDestructor != nil
 }
 
 func newContainer(parent *container) *container {
@@ -137,8 +382,8 @@ func newContainer(parent *container) *container {
 		parent,
 		make([]*alias, 0),
 		make([]*factory, 0),
-		make(map[*factory]interface{}),
-		make([]func() error, 0),
+		sync.Map{},
+		make([]*destructorEntry, 0),
 		sync.RWMutex{},
 	}
 }
@@ -162,61 +407,225 @@ func (this *container) RegisterFactory(v interface{}, ctor Constructor, dtor Des
 	this.UseFactory(t.String(), ctor, dtor, lifetime)
 }
 
+func (this *container) RegisterFactoryContext(v interface{}, ctor Constructor, dtor AsyncDestructor, lifetime Lifetime) {
+	t := reflect.TypeOf(v)
+	this.UseFactoryContext(t.String(), ctor, dtor, lifetime)
+}
+
+// `typeConstructor` builds a `Constructor` that creates a new zero/nil
+// instance of `typ`, injecting it if it is a struct. Shared by `UseType`
+// and `UseImpl`.
+func (this *container) typeConstructor(typ reflect.Type) Constructor {
+	return func(c Container) (interface{}, error) {
+		var instanceType reflect.Type
+		if typ.Kind() == reflect.Ptr {
+			instanceType = typ.Elem()
+		} else {
+			instanceType = typ
+		}
+
+		ptrInstance := reflect.New(instanceType)
+		if instanceType.Kind() == reflect.Struct {
+			if err := c.Inject(ptrInstance.Interface()); err != nil {
+				return nil, err
+			}
+		}
+
+		if typ.Kind() == reflect.Ptr {
+			return ptrInstance.Interface(), nil
+		} else {
+			return reflect.Indirect(ptrInstance).Interface(), nil
+		}
+	}
+}
+
 func (this *container) UseType(tag string, v interface{}, lifetime Lifetime) {
+	this.newBinding(tag).ToFactory(this.typeConstructor(reflect.TypeOf(v)), nil).In(lifetime)
+}
+
+func (this *container) UseValue(tag string, v interface{}) {
+	this.newBinding(tag).ToFactory(func(c Container) (interface{}, error) {
+		return v, nil
+	}, nil)
+}
+
+func (this *container) UseFactory(tag string, ctor Constructor, dtor Destructor, lifetime Lifetime) {
+	this.newBinding(tag).ToFactory(ctor, dtor).In(lifetime)
+}
+
+func (this *container) UseFactoryContext(tag string, ctor Constructor, dtor AsyncDestructor, lifetime Lifetime) {
 	this.lock.Lock()
 	defer this.lock.Unlock()
 
-	typ := reflect.TypeOf(v)
 	this.factories = append(this.factories, &factory{
-		Tag:      tag,
-		Lifetime: lifetime,
-		Constructor: func(c Container) (interface{}, error) {
-			var instanceType reflect.Type
-			if typ.Kind() == reflect.Ptr {
-				instanceType = typ.Elem()
-			} else {
-				instanceType = typ
-			}
+		Tag:             tag,
+		Lifetime:        lifetime,
+		Constructor:     ctor,
+		AsyncDestructor: dtor,
+	})
+}
 
-			ptrInstance := reflect.New(instanceType)
-			if instanceType.Kind() == reflect.Struct {
-				c.Inject(ptrInstance.Interface())
-			}
+func (this *container) RegisterImpl(ifacePtr interface{}, implPtr interface{}, lifetime Lifetime) {
+	ifaceType := reflect.TypeOf(ifacePtr)
+	if ifaceType.Kind() != reflect.Ptr || ifaceType.Elem().Kind() != reflect.Interface {
+		panic("di: ifacePtr must be a typed nil pointer to an interface, e.g. (*Logger)(nil)")
+	}
 
-			if typ.Kind() == reflect.Ptr {
-				return ptrInstance.Interface(), nil
-			} else {
-				return reflect.Indirect(ptrInstance).Interface(), nil
-			}
-		},
-		Destructor: nil,
+	this.UseImpl(ifaceType.Elem().String(), ifacePtr, implPtr, lifetime)
+}
+
+func (this *container) UseImpl(tag string, ifacePtr interface{}, implPtr interface{}, lifetime Lifetime) {
+	ifaceType := reflect.TypeOf(ifacePtr)
+	if ifaceType.Kind() != reflect.Ptr || ifaceType.Elem().Kind() != reflect.Interface {
+		panic("di: ifacePtr must be a typed nil pointer to an interface, e.g. (*Logger)(nil)")
+	}
+	iface := ifaceType.Elem()
+
+	implType := reflect.TypeOf(implPtr)
+	if !implType.Implements(iface) {
+		panic(fmt.Sprintf("di: %s does not implement %s", implType, iface))
+	}
+
+	this.lock.Lock()
+	defer this.lock.Unlock()
+
+	this.factories = append(this.factories, &factory{
+		Tag:         tag,
+		Lifetime:    lifetime,
+		Constructor: this.typeConstructor(implType),
+		Destructor:  nil,
 	})
 }
 
-func (this *container) UseValue(tag string, v interface{}) {
+var errType = reflect.TypeOf((*error)(nil)).Elem()
+
+func (this *container) RegisterConstructor(fn interface{}, lifetime Lifetime) {
+	fnType := reflect.TypeOf(fn)
+	if fnType.Kind() != reflect.Func {
+		panic("di: fn must be a function")
+	}
+	if fnType.NumOut() == 0 || fnType.NumOut() > 2 {
+		panic("di: fn must return (T) or (T, error)")
+	}
+	if fnType.NumOut() == 2 && !fnType.Out(1).Implements(errType) {
+		panic("di: fn's second return value must be error")
+	}
+
+	this.UseConstructor(fnType.Out(0).String(), fn, lifetime)
+}
+
+func (this *container) UseConstructor(tag string, fn interface{}, lifetime Lifetime) {
+	fnVal := reflect.ValueOf(fn)
+	fnType := fnVal.Type()
+	if fnType.Kind() != reflect.Func {
+		panic("di: fn must be a function")
+	}
+	if fnType.NumOut() == 0 || fnType.NumOut() > 2 {
+		panic("di: fn must return (T) or (T, error)")
+	}
+	if fnType.NumOut() == 2 && !fnType.Out(1).Implements(errType) {
+		panic("di: fn's second return value must be error")
+	}
+
 	this.lock.Lock()
 	defer this.lock.Unlock()
 
 	this.factories = append(this.factories, &factory{
 		Tag:      tag,
-		Lifetime: Transient,
+		Lifetime: lifetime,
 		Constructor: func(c Container) (interface{}, error) {
-			return v, nil
+			args := make([]reflect.Value, fnType.NumIn())
+			for i := 0; i < fnType.NumIn(); i++ {
+				dep, err := c.Resolve(fnType.In(i).String())
+				if err != nil {
+					return nil, err
+				}
+				args[i] = reflect.ValueOf(dep)
+			}
+
+			results := fnVal.Call(args)
+			if fnType.NumOut() == 2 {
+				if err, ok := results[1].Interface().(error); ok && err != nil {
+					return nil, err
+				}
+			}
+			return results[0].Interface(), nil
 		},
 		Destructor: nil,
 	})
 }
 
-func (this *container) UseFactory(tag string, ctor Constructor, dtor Destructor, lifetime Lifetime) {
+// `newBinding` registers a new, not-yet-configured factory for `tag` and
+// returns the `bindingBuilder` that owns it. `Bind`, `UseType`, `UseValue`
+// and `UseFactory` (and so `RegisterType`, `RegisterValue` and
+// `RegisterFactory`) are thin wrappers that call it and then refine the
+// result with `bindingBuilder`'s setters. `UseFactoryContext`, `UseImpl`
+// and `UseConstructor` (and their `Register*` counterparts) do not use it;
+// they append their `*factory` to `this.factories` directly.
+func (this *container) newBinding(tag string) *bindingBuilder {
 	this.lock.Lock()
-	defer this.lock.Unlock()
+	f := &factory{
+		Tag:      tag,
+		Lifetime: Transient,
+	}
+	this.factories = append(this.factories, f)
+	this.lock.Unlock()
 
-	this.factories = append(this.factories, &factory{
-		Tag:         tag,
-		Lifetime:    lifetime,
-		Constructor: ctor,
-		Destructor:  dtor,
-	})
+	return &bindingBuilder{this, f}
+}
+
+func (this *container) Bind(v interface{}) BindingBuilder {
+	typ := reflect.TypeOf(v)
+	return this.newBinding(typ.String()).ToFactory(this.typeConstructor(typ), nil)
+}
+
+// `bindingBuilder` is the default `BindingBuilder` implementation. It
+// mutates the `factory` it was seeded with in place, so each chained
+// call refines the same registration instead of appending a new one.
+type bindingBuilder struct {
+	container *container
+	factory   *factory
+}
+
+func (this *bindingBuilder) To(impl interface{}) BindingBuilder {
+	this.container.lock.Lock()
+	defer this.container.lock.Unlock()
+
+	this.factory.Constructor = this.container.typeConstructor(reflect.TypeOf(impl))
+	return this
+}
+
+func (this *bindingBuilder) ToFactory(ctor Constructor, dtor Destructor) BindingBuilder {
+	this.container.lock.Lock()
+	defer this.container.lock.Unlock()
+
+	this.factory.Constructor = ctor
+	this.factory.Destructor = dtor
+	return this
+}
+
+func (this *bindingBuilder) In(lifetime Lifetime) BindingBuilder {
+	this.container.lock.Lock()
+	defer this.container.lock.Unlock()
+
+	this.factory.Lifetime = lifetime
+	return this
+}
+
+func (this *bindingBuilder) As(tag string) BindingBuilder {
+	this.container.lock.Lock()
+	defer this.container.lock.Unlock()
+
+	this.factory.Tag = tag
+	return this
+}
+
+func (this *bindingBuilder) When(predicate func(ResolveContext) bool) BindingBuilder {
+	this.container.lock.Lock()
+	defer this.container.lock.Unlock()
+
+	this.factory.Predicate = predicate
+	return this
 }
 
 func (this *container) Use(tag string, tagOrTypeName string) {
@@ -269,7 +678,117 @@ func (this *container) resolveAliases(tag string) tags {
 	return tags
 }
 
-func (this *container) createInstance(f *factory) (interface{}, error) {
+// `contextualContainer` wraps a `*container` together with the
+// `ResolveContext` of the resolution currently being constructed, so
+// that the `Constructor` it is passed to can resolve further
+// dependencies (directly, or through `Inject`) without losing track of
+// the `When` predicate / cycle-detection state. All other `Container`
+// methods are delegated to the wrapped `*container` unchanged.
+type contextualContainer struct {
+	*container
+	rctx ResolveContext
+}
+
+func (this *contextualContainer) Resolve(tag string) (interface{}, error) {
+	return this.container.resolve(this.rctx.child(tag, nil, ""))
+}
+
+func (this *contextualContainer) ResolveAll(tag string) ([]interface{}, error) {
+	return this.container.resolveAll(this.rctx.child(tag, nil, ""))
+}
+
+func (this *contextualContainer) ResolveContext(ctx context.Context, tag string) (interface{}, error) {
+	rctx := this.rctx.child(tag, nil, "")
+	rctx.Ctx = ctx
+	return this.container.resolve(rctx)
+}
+
+func (this *contextualContainer) Inject(v interface{}) error {
+	return this.container.injectContext(v, this.rctx)
+}
+
+// `singleflight` looks up (or, on the first caller, creates) the cached
+// instance of `f` in `scope`'s cache, guaranteeing that `f.Constructor`
+// runs exactly once even if multiple goroutines resolve `f` concurrently.
+//
+// The constructor is started by whichever caller's `LoadOrStore` wins
+// the race, but it always runs to completion -- with its `Ctx` stripped,
+// since the result is shared by every caller, not just the winner --
+// regardless of whether that particular caller's own resolution is later
+// cancelled. Each caller (winner included) then waits for either the
+// shared `cacheEntry.done` or its own `rctx.Ctx.Done()`, so one caller's
+// `ResolveContext` cancellation can never fail another caller's resolve,
+// nor abort the construction everyone else is waiting on.
+//
+// If the constructor fails, the entry is removed from `scope.cache`
+// rather than cached, so the next `Resolve`/`ResolveContext` call
+// retries instead of replaying the same failure forever.
+func (this *container) singleflight(scope *container, f *factory, rctx ResolveContext) (interface{}, error) {
+	entryI, loaded := scope.cache.LoadOrStore(f, newCacheEntry())
+	entry := entryI.(*cacheEntry)
+
+	if !loaded {
+		go func() {
+			defer close(entry.done)
+
+			collector := &childCollector{}
+			childRctx := rctx
+			childRctx.Ctx = nil
+			childRctx.collector = collector
+
+			entry.val, entry.err = f.Constructor(&contextualContainer{this, childRctx})
+			if entry.err != nil {
+				scope.cache.CompareAndDelete(f, entry)
+				return
+			}
+
+			if f.hasDestructor() {
+				instance := entry.val
+				entry.dtorEntry = &destructorEntry{
+					run: func(ctx context.Context) error {
+						return f.destroy(ctx, instance)
+					},
+					deps: collector.entries,
+				}
+				scope.lock.Lock()
+				scope.destructors = append(scope.destructors, entry.dtorEntry)
+				scope.lock.Unlock()
+			} else {
+				entry.children = collector.entries
+			}
+		}()
+	}
+
+	if rctx.Ctx != nil {
+		select {
+		case <-entry.done:
+		case <-rctx.Ctx.Done():
+			return nil, rctx.Ctx.Err()
+		}
+	} else {
+		<-entry.done
+	}
+
+	if entry.err == nil && rctx.collector != nil {
+		if entry.dtorEntry != nil {
+			rctx.collector.add(entry.dtorEntry)
+		} else {
+			rctx.collector.add(entry.children...)
+		}
+	}
+
+	return entry.val, entry.err
+}
+
+// `createInstance` constructs an instance of `f`, delegating to
+// `singleflight` for `Scoped`/`Singleton` lifetimes so that concurrent
+// resolutions never double-construct. For `Transient` instances, a
+// fresh `childCollector` gathers the `destructorEntry`s created while
+// resolving this instance's own dependencies, so that -- if `f` itself
+// has a destructor -- they can be recorded as its dependencies, or --
+// if it doesn't -- bubbled up to whoever is constructing `this`
+// instance as a dependency of theirs.
+func (this *container) createInstance(f *factory, rctx ResolveContext) (interface{}, error) {
 	root := func(c *container) *container {
 		for ; c.parent != nil; c = c.parent {
 		}
@@ -278,104 +797,140 @@ func (this *container) createInstance(f *factory) (interface{}, error) {
 
 	switch f.Lifetime {
 	case Scoped:
-		this.lock.RLock()
-		cached, ok := this.cache[f]
-		this.lock.RUnlock()
-		if ok {
-			return cached, nil
-		}
+		return this.singleflight(this, f, rctx)
 	case Singleton:
-		root.lock.RLock()
-		cached, ok := root.cache[f]
-		root.lock.RUnlock()
-		if ok {
-			return cached, nil
-		}
+		return this.singleflight(root, f, rctx)
 	}
 
-	instance, err := f.Constructor(this)
+	collector := &childCollector{}
+	childRctx := rctx
+	childRctx.collector = collector
+
+	instance, err := f.Constructor(&contextualContainer{this, childRctx})
 	if err != nil {
 		return instance, err
 	}
 
-	switch f.Lifetime {
-	case Scoped:
+	if f.hasDestructor() {
+		entry := &destructorEntry{
+			run: func(ctx context.Context) error {
+				return f.destroy(ctx, instance)
+			},
+			deps: collector.entries,
+		}
+
 		this.lock.Lock()
-		this.cache[f] = instance
+		this.destructors = append(this.destructors, entry)
 		this.lock.Unlock()
-	case Singleton:
-		root.lock.Lock()
-		root.cache[f] = instance
-		root.lock.Unlock()
-	}
-
-	if f.Destructor != nil {
-		switch f.Lifetime {
-		case Transient:
-			fallthrough
-		case Scoped:
-			this.lock.Lock()
-			this.destructors = append(this.destructors, func() error {
-				return f.Destructor(instance)
-			})
-			this.lock.Unlock()
-		case Singleton:
-			root.lock.Lock()
-			root.destructors = append(root.destructors, func() error {
-				return f.Destructor(instance)
-			})
-			root.lock.Unlock()
+
+		if rctx.collector != nil {
+			rctx.collector.add(entry)
 		}
+	} else if rctx.collector != nil {
+		rctx.collector.add(collector.entries...)
 	}
 
 	return instance, nil
 }
 
-func (this *container) Resolve(tag string) (interface{}, error) {
-	factory, found := func() (*factory, bool) {
-		this.lock.RLock()
-		defer this.lock.RUnlock()
+// `lookup` finds the factory registered for `rctx.Tag`. If several
+// factories match, the last registered one whose `Predicate` returns
+// true for `rctx` wins; if none match, the last registered factory
+// without a `Predicate` is used instead.
+//
+// Candidate factories are snapshotted under `this.lock`, then predicates
+// are evaluated after releasing it: a `Predicate` is arbitrary user code
+// that may itself call back into the container (e.g. `Resolve`), and
+// running it while still holding `RLock` can deadlock against a
+// concurrent writer (`Use*`, `Bind`, ...) queued behind the held lock.
+func (this *container) lookup(rctx ResolveContext) (*factory, bool) {
+	candidates := this.candidates(rctx.Tag)
+
+	var fallback *factory
+	for _, f := range candidates {
+		if f.Predicate != nil {
+			if f.Predicate(rctx) {
+				return f, true
+			}
+			continue
+		}
 
-		tags := this.resolveAliases(tag)
+		if fallback == nil {
+			fallback = f
+		}
+	}
 
-		for c := this; c != nil; c = c.parent {
-			for i := len(c.factories) - 1; 0 <= i; i-- {
-				if tags.Contains(c.factories[i].Tag) {
-					return c.factories[i], true
-				}
+	if fallback != nil {
+		return fallback, true
+	}
+	return nil, false
+}
+
+// `candidates` returns the factories registered for `tag` (or any tag it
+// aliases to), from last registered to first, across this container and
+// its ancestors.
+func (this *container) candidates(tag string) []*factory {
+	this.lock.RLock()
+	defer this.lock.RUnlock()
+
+	tags := this.resolveAliases(tag)
+
+	var candidates []*factory
+	for c := this; c != nil; c = c.parent {
+		for i := len(c.factories) - 1; 0 <= i; i-- {
+			if f := c.factories[i]; tags.Contains(f.Tag) {
+				candidates = append(candidates, f)
 			}
 		}
+	}
 
-		return nil, false
-	}()
+	return candidates
+}
 
-	if found {
-		return this.createInstance(factory)
-	} else {
+func (this *container) resolve(rctx ResolveContext) (interface{}, error) {
+	for _, tag := range rctx.Chain {
+		if tag == rctx.Tag {
+			chain := append(append([]string{}, rctx.Chain...), rctx.Tag)
+			return nil, &circularDependencyError{Chain: chain}
+		}
+	}
+
+	if rctx.Ctx != nil {
+		select {
+		case <-rctx.Ctx.Done():
+			return nil, rctx.Ctx.Err()
+		default:
+		}
+	}
+
+	f, found := this.lookup(rctx)
+	if !found {
 		return nil, ErrNoMatchingTag
 	}
+
+	return this.createInstance(f, rctx)
 }
 
-func (this *container) ResolveAll(tag string) ([]interface{}, error) {
-	factories := make([]*factory, 0, 10)
-	func() {
-		this.lock.RLock()
-		defer this.lock.RUnlock()
+func (this *container) Resolve(tag string) (interface{}, error) {
+	return this.resolve(ResolveContext{}.child(tag, nil, ""))
+}
 
-		tags := this.resolveAliases(tag)
+func (this *container) ResolveContext(ctx context.Context, tag string) (interface{}, error) {
+	return this.resolve(ResolveContext{Ctx: ctx}.child(tag, nil, ""))
+}
 
-		for c := this; c != nil; c = c.parent {
-			for i := len(c.factories) - 1; 0 <= i; i-- {
-				if tags.Contains(c.factories[i].Tag) {
-					factories = append(factories, c.factories[i])
-				}
-			}
+func (this *container) resolveAll(rctx ResolveContext) ([]interface{}, error) {
+	var factories []*factory
+	for _, f := range this.candidates(rctx.Tag) {
+		if f.Predicate != nil && !f.Predicate(rctx) {
+			continue
 		}
-	}()
+		factories = append(factories, f)
+	}
 
 	var instances []interface{}
 	for i := len(factories) - 1; 0 <= i; i-- {
-		v, err := this.createInstance(factories[i])
+		v, err := this.createInstance(factories[i], rctx)
 		if err != nil {
 			return nil, err
 		}
@@ -385,7 +940,11 @@ func (this *container) ResolveAll(tag string) ([]interface{}, error) {
 	return instances, nil
 }
 
-func (this *container) Inject(v interface{}) error {
+func (this *container) ResolveAll(tag string) ([]interface{}, error) {
+	return this.resolveAll(ResolveContext{}.child(tag, nil, ""))
+}
+
+func (this *container) injectContext(v interface{}, rctx ResolveContext) error {
 	val := reflect.ValueOf(v)
 	if val.Type().Kind() == reflect.Ptr {
 		val = reflect.Indirect(val)
@@ -398,7 +957,7 @@ func (this *container) Inject(v interface{}) error {
 	for i := 0; i < t.NumField(); i++ {
 		f := t.Field(i)
 		if tag := f.Tag.Get("di"); tag != "" {
-			fi, err := this.Resolve(tag)
+			fi, err := this.resolve(rctx.child(tag, t, f.Name))
 			if err != nil {
 				return err
 			}
@@ -409,19 +968,91 @@ func (this *container) Inject(v interface{}) error {
 	return nil
 }
 
+func (this *container) Inject(v interface{}) error {
+	return this.injectContext(v, ResolveContext{})
+}
+
 func (this *container) Close() error {
+	return this.CloseContext(context.Background())
+}
+
+// `CloseContext` destroys this container's instances one "generation" at
+// a time: a generation is every not-yet-destroyed entry whose
+// dependents (the instances whose construction resolved it) have all
+// already been destroyed. Entries within a generation have no ordering
+// constraint between them, so they run concurrently; generations
+// themselves run in an order consistent with reverse-registration order.
+func (this *container) CloseContext(ctx context.Context) error {
 	this.lock.Lock()
-	dtors := make([]func() error, len(this.destructors))
-	copy(dtors, this.destructors)
+	entries := append([]*destructorEntry(nil), this.destructors...)
 	this.destructors = this.destructors[:0]
 	this.lock.Unlock()
 
-	for i := len(dtors) - 1; 0 <= i; i-- {
-		err := dtors[i]()
-		if err != nil {
-			return err
+	inSet := make(map[*destructorEntry]bool, len(entries))
+	for _, e := range entries {
+		inSet[e] = true
+	}
+
+	inDegree := make(map[*destructorEntry]int, len(entries))
+	for _, u := range entries {
+		for _, v := range u.deps {
+			if inSet[v] {
+				inDegree[v]++
+			}
 		}
 	}
 
-	return nil
+	done := make(map[*destructorEntry]bool, len(entries))
+	var errs []error
+
+	for len(done) < len(entries) {
+		select {
+		case <-ctx.Done():
+			errs = append(errs, ctx.Err())
+			return errors.Join(errs...)
+		default:
+		}
+
+		var generation []*destructorEntry
+		for i := len(entries) - 1; 0 <= i; i-- {
+			if e := entries[i]; !done[e] && inDegree[e] == 0 {
+				generation = append(generation, e)
+			}
+		}
+		if len(generation) == 0 {
+			// Only possible if deps form a cycle, which `Resolve` already
+			// guards against. Fall back to draining the remainder rather
+			// than looping forever.
+			for i := len(entries) - 1; 0 <= i; i-- {
+				if e := entries[i]; !done[e] {
+					generation = append(generation, e)
+				}
+			}
+		}
+
+		results := make([]error, len(generation))
+		var wg sync.WaitGroup
+		for i, e := range generation {
+			wg.Add(1)
+			go func(i int, e *destructorEntry) {
+				defer wg.Done()
+				results[i] = e.run(ctx)
+			}(i, e)
+		}
+		wg.Wait()
+
+		for i, e := range generation {
+			done[e] = true
+			if results[i] != nil {
+				errs = append(errs, results[i])
+			}
+			for _, v := range e.deps {
+				if inSet[v] {
+					inDegree[v]--
+				}
+			}
+		}
+	}
+
+	return errors.Join(errs...)
 }
@@ -1,6 +1,13 @@
 package di
 
+import "context"
+import "errors"
+import "fmt"
+import "reflect"
+import "sync"
+import "sync/atomic"
 import "testing"
+import "time"
 import "github.com/stretchr/testify/assert"
 
 type MyStruct struct {
@@ -181,6 +188,383 @@ func TestClose(t *testing.T) {
 	assert.Equal(t, true, closed)
 }
 
+type MyInterface interface {
+	DoSomething() string
+}
+
+type MyImpl struct {
+}
+
+func (this *MyImpl) DoSomething() string {
+	return "done"
+}
+
+func TestRegisterImpl(t *testing.T) {
+	c := newContainer(nil)
+
+	c.RegisterImpl((*MyInterface)(nil), &MyImpl{}, Transient)
+
+	assert.Equal(t, 1, len(c.factories))
+	f := c.factories[0]
+	assert.Equal(t, "di.MyInterface", f.Tag)
+	assert.Equal(t, Transient, f.Lifetime)
+	assert.NotNil(t, f.Constructor)
+	assert.Nil(t, f.Destructor)
+}
+
+func TestResolve_RegisteredImpl(t *testing.T) {
+	c := newContainer(nil)
+
+	c.RegisterImpl((*MyInterface)(nil), &MyImpl{}, Transient)
+
+	v, err := c.Resolve("di.MyInterface")
+	assert.NoError(t, err)
+	assert.Implements(t, (*MyInterface)(nil), v)
+	assert.Equal(t, "done", v.(MyInterface).DoSomething())
+}
+
+func TestUseImpl_PanicsIfNotImplemented(t *testing.T) {
+	c := newContainer(nil)
+
+	assert.Panics(t, func() {
+		c.UseImpl("iface", (*MyInterface)(nil), &MyStruct{}, Transient)
+	})
+}
+
+type MyService struct {
+	Struct *MyStruct
+	Impl   MyInterface
+}
+
+func TestRegisterConstructor(t *testing.T) {
+	c := newContainer(nil)
+
+	c.RegisterConstructor(func(s *MyStruct) *MyService {
+		return &MyService{Struct: s}
+	}, Transient)
+
+	assert.Equal(t, 1, len(c.factories))
+	f := c.factories[0]
+	assert.Equal(t, "*di.MyService", f.Tag)
+	assert.Equal(t, Transient, f.Lifetime)
+	assert.NotNil(t, f.Constructor)
+	assert.Nil(t, f.Destructor)
+}
+
+func TestResolve_RegisteredConstructor(t *testing.T) {
+	c := newContainer(nil)
+
+	c.RegisterType(&MyStruct{}, Transient)
+	c.RegisterConstructor(func(s *MyStruct) *MyService {
+		return &MyService{Struct: s}
+	}, Transient)
+
+	v, err := c.Resolve("*di.MyService")
+	assert.NoError(t, err)
+	assert.Equal(t, &MyService{Struct: &MyStruct{}}, v)
+}
+
+func TestResolve_RegisteredConstructor_WithInterfaceParam(t *testing.T) {
+	c := newContainer(nil)
+
+	c.RegisterImpl((*MyInterface)(nil), &MyImpl{}, Transient)
+	c.RegisterConstructor(func(i MyInterface) *MyService {
+		return &MyService{Impl: i}
+	}, Transient)
+
+	v, err := c.Resolve("*di.MyService")
+	assert.NoError(t, err)
+	assert.Equal(t, "done", v.(*MyService).Impl.DoSomething())
+}
+
+func TestResolve_RegisteredConstructor_WithError(t *testing.T) {
+	c := newContainer(nil)
+
+	myErr := fmt.Errorf("construction failed")
+	c.RegisterConstructor(func() (*MyService, error) {
+		return nil, myErr
+	}, Transient)
+
+	_, err := c.Resolve("*di.MyService")
+	assert.Equal(t, myErr, err)
+}
+
+func TestBind(t *testing.T) {
+	c := newContainer(nil)
+
+	c.Bind(&MyStruct{})
+
+	assert.Equal(t, 1, len(c.factories))
+	f := c.factories[0]
+	assert.Equal(t, "*di.MyStruct", f.Tag)
+	assert.Equal(t, Transient, f.Lifetime)
+	assert.NotNil(t, f.Constructor)
+	assert.Nil(t, f.Destructor)
+}
+
+func TestBind_ToAsIn(t *testing.T) {
+	c := newContainer(nil)
+
+	c.Bind((*MyInterface)(nil)).To(&MyImpl{}).As("iface").In(Singleton)
+
+	v, err := c.Resolve("iface")
+	assert.NoError(t, err)
+	assert.Equal(t, "done", v.(MyInterface).DoSomething())
+
+	v2, err := c.Resolve("iface")
+	assert.NoError(t, err)
+	assert.True(t, v == v2)
+}
+
+func TestBind_ToFactory(t *testing.T) {
+	c := newContainer(nil)
+
+	closed := false
+	c.Bind(&MyStruct{}).ToFactory(func(c Container) (interface{}, error) {
+		return &MyStruct{Name: "factory"}, nil
+	}, func(v interface{}) error {
+		closed = true
+		return nil
+	})
+
+	v, err := c.Resolve("*di.MyStruct")
+	assert.NoError(t, err)
+	assert.Equal(t, &MyStruct{Name: "factory"}, v)
+
+	c.Close()
+	assert.True(t, closed)
+}
+
+type MyImpl2 struct {
+}
+
+func (this *MyImpl2) DoSomething() string {
+	return "done2"
+}
+
+type logConsumer struct {
+	Logger MyInterface `di:"logger"`
+}
+
+func TestResolve_When_PicksMatchingPredicate(t *testing.T) {
+	c := newContainer(nil)
+
+	consumerType := reflect.TypeOf(logConsumer{})
+
+	c.Bind((*MyInterface)(nil)).As("logger").To(&MyImpl{})
+	c.Bind((*MyInterface)(nil)).As("logger").To(&MyImpl2{}).When(func(rctx ResolveContext) bool {
+		return rctx.ParentType == consumerType
+	})
+
+	v, err := c.Resolve("logger")
+	assert.NoError(t, err)
+	assert.Equal(t, "done", v.(MyInterface).DoSomething())
+
+	var holder logConsumer
+	err = c.Inject(&holder)
+	assert.NoError(t, err)
+	assert.Equal(t, "done2", holder.Logger.DoSomething())
+}
+
+func TestResolve_When_FallsBackToUnguarded(t *testing.T) {
+	c := newContainer(nil)
+
+	c.Bind((*MyInterface)(nil)).As("logger").To(&MyImpl{})
+	c.Bind((*MyInterface)(nil)).As("logger").To(&MyImpl2{}).When(func(rctx ResolveContext) bool {
+		return false
+	})
+
+	v, err := c.Resolve("logger")
+	assert.NoError(t, err)
+	assert.Equal(t, "done", v.(MyInterface).DoSomething())
+}
+
+func TestResolve_When_PredicateCanResolveWithoutDeadlock(t *testing.T) {
+	c := newContainer(nil)
+	c.UseValue("flag", true)
+
+	c.Bind((*MyInterface)(nil)).As("logger").To(&MyImpl{})
+	c.Bind((*MyInterface)(nil)).As("logger").To(&MyImpl2{}).When(func(rctx ResolveContext) bool {
+		v, err := c.Resolve("flag")
+		return err == nil && v.(bool)
+	})
+
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 100; i++ {
+			c.UseValue(fmt.Sprintf("writer%d", i), i)
+		}
+	}()
+
+	done := make(chan struct{})
+	go func() {
+		for i := 0; i < 100; i++ {
+			v, err := c.Resolve("logger")
+			assert.NoError(t, err)
+			assert.Equal(t, "done2", v.(MyInterface).DoSomething())
+		}
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Resolve deadlocked while a When predicate resolved concurrently with a writer")
+	}
+	wg.Wait()
+}
+
+type SelfRef struct {
+	Self *SelfRef `di:"*di.SelfRef"`
+}
+
+func TestResolve_SelfCycle(t *testing.T) {
+	c := newContainer(nil)
+	c.RegisterType(&SelfRef{}, Transient)
+
+	_, err := c.Resolve("*di.SelfRef")
+	assert.Error(t, err)
+	assert.True(t, errors.Is(err, ErrCircularDependency))
+}
+
+type CycleA struct {
+	B *CycleB `di:"*di.CycleB"`
+}
+
+type CycleB struct {
+	A *CycleA `di:"*di.CycleA"`
+}
+
+func TestResolve_TwoNodeCycle(t *testing.T) {
+	c := newContainer(nil)
+	c.RegisterType(&CycleA{}, Transient)
+	c.RegisterType(&CycleB{}, Transient)
+
+	_, err := c.Resolve("*di.CycleA")
+	assert.Error(t, err)
+	assert.True(t, errors.Is(err, ErrCircularDependency))
+}
+
+func TestResolveContext_Cancelled(t *testing.T) {
+	c := newContainer(nil)
+	c.RegisterValue(42)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	_, err := c.ResolveContext(ctx, "int")
+	assert.Equal(t, context.Canceled, err)
+}
+
+func TestResolveContext_CancelledMidResolution(t *testing.T) {
+	c := newContainer(nil)
+	ctx, cancel := context.WithCancel(context.Background())
+
+	c.UseFactory("a", func(c Container) (interface{}, error) {
+		cancel()
+		return c.Resolve("b")
+	}, nil, Transient)
+	c.UseValue("b", 1)
+
+	_, err := c.ResolveContext(ctx, "a")
+	assert.Equal(t, context.Canceled, err)
+}
+
+func TestResolve_SingletonCache_ConcurrentSingleFlight(t *testing.T) {
+	c := newContainer(nil)
+
+	var count int32
+	c.UseFactory("slow", func(c Container) (interface{}, error) {
+		time.Sleep(10 * time.Millisecond)
+		atomic.AddInt32(&count, 1)
+		return &MyStruct{}, nil
+	}, nil, Singleton)
+
+	const n = 50
+	results := make([]interface{}, n)
+	var wg sync.WaitGroup
+	wg.Add(n)
+	for i := 0; i < n; i++ {
+		go func(i int) {
+			defer wg.Done()
+			v, err := c.Resolve("slow")
+			assert.NoError(t, err)
+			results[i] = v
+		}(i)
+	}
+	wg.Wait()
+
+	assert.Equal(t, int32(1), atomic.LoadInt32(&count))
+	for i := 1; i < n; i++ {
+		assert.True(t, results[0] == results[i])
+	}
+}
+
+func TestResolve_SingletonCache_RetriesAfterFailure(t *testing.T) {
+	c := newContainer(nil)
+
+	failOnce := true
+	var count int32
+	c.UseFactory("flaky", func(c Container) (interface{}, error) {
+		atomic.AddInt32(&count, 1)
+		if failOnce {
+			failOnce = false
+			return nil, errors.New("transient failure")
+		}
+		return &MyStruct{}, nil
+	}, nil, Singleton)
+
+	_, err := c.Resolve("flaky")
+	assert.Error(t, err)
+
+	v, err := c.Resolve("flaky")
+	assert.NoError(t, err)
+	assert.Equal(t, &MyStruct{}, v)
+	assert.Equal(t, int32(2), atomic.LoadInt32(&count))
+}
+
+func TestResolveContext_SingletonCache_CancelledCallerDoesNotFailOthers(t *testing.T) {
+	c := newContainer(nil)
+
+	started := make(chan struct{})
+	proceed := make(chan struct{})
+	c.UseFactory("slow", func(c Container) (interface{}, error) {
+		close(started)
+		<-proceed
+		return &MyStruct{}, nil
+	}, nil, Singleton)
+
+	ctxA, cancelA := context.WithCancel(context.Background())
+
+	var errA error
+	doneA := make(chan struct{})
+	go func() {
+		defer close(doneA)
+		_, errA = c.ResolveContext(ctxA, "slow")
+	}()
+
+	<-started
+	cancelA()
+	<-doneA
+	assert.True(t, errors.Is(errA, context.Canceled))
+
+	var v interface{}
+	var errB error
+	doneB := make(chan struct{})
+	go func() {
+		defer close(doneB)
+		v, errB = c.ResolveContext(context.Background(), "slow")
+	}()
+
+	close(proceed)
+	<-doneB
+
+	assert.NoError(t, errB)
+	assert.Equal(t, &MyStruct{}, v)
+}
+
 func TestResolve_Hierarchical(t *testing.T) {
 	root := newContainer(nil)
 	c := newContainer(root)
@@ -330,3 +714,170 @@ func TestResolveAll(t *testing.T) {
 	assert.Equal(t, 2, v[1])
 	assert.Equal(t, 3, v[2])
 }
+
+func TestRegisterFactoryContext(t *testing.T) {
+	c := newContainer(nil)
+
+	var a *MyStruct
+	c.RegisterFactoryContext(a, func(c Container) (interface{}, error) {
+		return &MyStruct{}, nil
+	}, func(ctx context.Context, v interface{}) error {
+		return nil
+	}, Transient)
+
+	v, err := c.Resolve("*di.MyStruct")
+	assert.NoError(t, err)
+	assert.Equal(t, &MyStruct{}, v)
+	assert.Equal(t, 1, len(c.destructors))
+}
+
+func TestCloseContext_RunsAsyncDestructor(t *testing.T) {
+	c := newContainer(nil)
+
+	var a *MyStruct
+	closed := false
+	c.UseFactoryContext("struct", func(c Container) (interface{}, error) {
+		return &MyStruct{}, nil
+	}, func(ctx context.Context, v interface{}) error {
+		closed = true
+		return nil
+	}, Transient)
+	_ = a
+
+	_, err := c.Resolve("struct")
+	assert.NoError(t, err)
+
+	assert.NoError(t, c.CloseContext(context.Background()))
+	assert.Equal(t, true, closed)
+}
+
+func TestCloseContext_DestroysDependentBeforeDependency(t *testing.T) {
+	c := newContainer(nil)
+
+	var order []string
+	var lock sync.Mutex
+	record := func(name string) AsyncDestructor {
+		return func(ctx context.Context, v interface{}) error {
+			lock.Lock()
+			order = append(order, name)
+			lock.Unlock()
+			return nil
+		}
+	}
+
+	c.UseFactoryContext("dependency", func(c Container) (interface{}, error) {
+		return "dependency", nil
+	}, record("dependency"), Transient)
+	c.UseFactoryContext("dependent", func(c Container) (interface{}, error) {
+		_, err := c.Resolve("dependency")
+		return "dependent", err
+	}, record("dependent"), Transient)
+
+	_, err := c.Resolve("dependent")
+	assert.NoError(t, err)
+
+	assert.NoError(t, c.CloseContext(context.Background()))
+	assert.Equal(t, []string{"dependent", "dependency"}, order)
+}
+
+func TestCloseContext_IndependentDestructorsRunConcurrently(t *testing.T) {
+	c := newContainer(nil)
+
+	const n = 10
+	var running int32
+	var maxRunning int32
+	block := func(ctx context.Context, v interface{}) error {
+		cur := atomic.AddInt32(&running, 1)
+		for {
+			old := atomic.LoadInt32(&maxRunning)
+			if cur <= old || atomic.CompareAndSwapInt32(&maxRunning, old, cur) {
+				break
+			}
+		}
+		time.Sleep(10 * time.Millisecond)
+		atomic.AddInt32(&running, -1)
+		return nil
+	}
+
+	for i := 0; i < n; i++ {
+		c.UseFactoryContext(fmt.Sprintf("item%d", i), func(c Container) (interface{}, error) {
+			return struct{}{}, nil
+		}, block, Transient)
+		_, err := c.Resolve(fmt.Sprintf("item%d", i))
+		assert.NoError(t, err)
+	}
+
+	assert.NoError(t, c.CloseContext(context.Background()))
+	assert.True(t, atomic.LoadInt32(&maxRunning) > 1)
+}
+
+func TestCloseContext_CancelledAbortsRemainingGenerations(t *testing.T) {
+	c := newContainer(nil)
+
+	ctx, cancel := context.WithCancel(context.Background())
+
+	c.UseFactoryContext("dependency", func(c Container) (interface{}, error) {
+		return "dependency", nil
+	}, func(ctx context.Context, v interface{}) error {
+		return nil
+	}, Transient)
+	c.UseFactoryContext("dependent", func(c Container) (interface{}, error) {
+		_, err := c.Resolve("dependency")
+		return "dependent", err
+	}, func(ctx context.Context, v interface{}) error {
+		cancel()
+		return nil
+	}, Transient)
+
+	_, err := c.Resolve("dependent")
+	assert.NoError(t, err)
+
+	err = c.CloseContext(ctx)
+	assert.Error(t, err)
+	assert.True(t, errors.Is(err, context.Canceled))
+}
+
+func TestCloseContext_AggregatesErrors(t *testing.T) {
+	c := newContainer(nil)
+
+	err1 := errors.New("err1")
+	err2 := errors.New("err2")
+	c.UseFactoryContext("a", func(c Container) (interface{}, error) {
+		return "a", nil
+	}, func(ctx context.Context, v interface{}) error {
+		return err1
+	}, Transient)
+	c.UseFactoryContext("b", func(c Container) (interface{}, error) {
+		return "b", nil
+	}, func(ctx context.Context, v interface{}) error {
+		return err2
+	}, Transient)
+
+	_, err := c.Resolve("a")
+	assert.NoError(t, err)
+	_, err = c.Resolve("b")
+	assert.NoError(t, err)
+
+	err = c.CloseContext(context.Background())
+	assert.Error(t, err)
+	assert.True(t, errors.Is(err, err1))
+	assert.True(t, errors.Is(err, err2))
+}
+
+func TestClose_StillRunsLegacyDestructor(t *testing.T) {
+	c := newContainer(nil)
+
+	closed := false
+	c.UseFactory("struct", func(c Container) (interface{}, error) {
+		return &MyStruct{}, nil
+	}, func(v interface{}) error {
+		closed = true
+		return nil
+	}, Transient)
+
+	_, err := c.Resolve("struct")
+	assert.NoError(t, err)
+
+	assert.NoError(t, c.Close())
+	assert.Equal(t, true, closed)
+}